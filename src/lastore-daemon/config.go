@@ -0,0 +1,297 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"sync"
+	"time"
+)
+
+const configPath = "/var/lib/lastore/config.json"
+
+// Config persists lastore-daemon's on-disk settings.
+type Config struct {
+	mu sync.Mutex
+
+	AppstoreRegion string
+
+	AutoCheckUpdates    bool
+	AutoDownloadUpdates bool
+
+	// LastSchedulerRuns records, per Scheduler.Name, the unix time it last
+	// ran, so SchedulerLoop can compute NextScheduledTime across restarts.
+	LastSchedulerRuns map[string]int64
+
+	// DownloadSpeedLimit caps DownloadQueue's aggregate speed in bytes
+	// per second; 0 means unlimited.
+	DownloadSpeedLimit int64
+
+	// UnmeteredWindowStart/End, in minutes since midnight local time, name
+	// a daily window (e.g. 02:00-06:00) during which DownloadSpeedLimit is
+	// not applied. Equal values disable the window.
+	UnmeteredWindowStart int
+	UnmeteredWindowEnd   int
+
+	// JobHistoryRetentionDays bounds how long finished job history is
+	// kept; <=0 falls back to defaultJobHistoryRetentionDays.
+	JobHistoryRetentionDays int
+
+	// JobTTLSeconds bounds, for most job types, how long a finished job is
+	// kept before gcFinishedJobs sweeps it; <=0 falls back to
+	// defaultJobTTLSeconds.
+	JobTTLSeconds int64
+
+	// DistUpgradeTTLSeconds is JobTTLSeconds's DistUpgradeJobType override,
+	// long enough that a failed upgrade stays visible in the UI; <=0 falls
+	// back to defaultDistUpgradeTTLSeconds.
+	DistUpgradeTTLSeconds int64
+
+	// JobTimeoutSeconds bounds, for most job types, how long a job may stay
+	// in RunningStatus before timeoutRunningJobs aborts and fails it; <=0
+	// falls back to defaultJobTimeoutSeconds.
+	JobTimeoutSeconds int64
+
+	// UpdateSourceTimeoutSeconds and DistUpgradeTimeoutSeconds are
+	// JobTimeoutSeconds's per-JobType overrides; <=0 falls back to
+	// defaultUpdateSourceTimeoutSeconds / defaultDistUpgradeTimeoutSeconds.
+	UpdateSourceTimeoutSeconds int64
+	DistUpgradeTimeoutSeconds  int64
+}
+
+const (
+	defaultJobHistoryRetentionDays = 30
+
+	defaultJobTTLSeconds         = int64(time.Minute / time.Second)
+	defaultDistUpgradeTTLSeconds = int64(7 * 24 * time.Hour / time.Second)
+
+	defaultJobTimeoutSeconds          = int64(30 * time.Minute / time.Second)
+	defaultUpdateSourceTimeoutSeconds = int64(5 * time.Minute / time.Second)
+	defaultDistUpgradeTimeoutSeconds  = int64(2 * time.Hour / time.Second)
+)
+
+// JobHistoryRetention returns how long finished job history should be kept
+// before the history store's GC trims it.
+func (c *Config) JobHistoryRetention() time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	days := c.JobHistoryRetentionDays
+	if days <= 0 {
+		days = defaultJobHistoryRetentionDays
+	}
+	return time.Duration(days) * 24 * time.Hour
+}
+
+// SetJobHistoryRetentionDays persists how many days of finished job
+// history to keep.
+func (c *Config) SetJobHistoryRetentionDays(days int) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.JobHistoryRetentionDays = days
+	return c.save()
+}
+
+// JobTTL returns the default TTLSecondsAfterFinished, as a time.Duration,
+// for job types other than DistUpgradeJobType.
+func (c *Config) JobTTL() time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s := c.JobTTLSeconds
+	if s <= 0 {
+		s = defaultJobTTLSeconds
+	}
+	return time.Duration(s) * time.Second
+}
+
+// DistUpgradeTTL returns the default TTLSecondsAfterFinished for a
+// DistUpgradeJobType job.
+func (c *Config) DistUpgradeTTL() time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s := c.DistUpgradeTTLSeconds
+	if s <= 0 {
+		s = defaultDistUpgradeTTLSeconds
+	}
+	return time.Duration(s) * time.Second
+}
+
+// SetJobTTLSeconds persists the default job TTL, in seconds, used by
+// defaultTTL for job types other than DistUpgradeJobType.
+func (c *Config) SetJobTTLSeconds(seconds int64) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.JobTTLSeconds = seconds
+	return c.save()
+}
+
+// SetDistUpgradeTTLSeconds persists the DistUpgradeJobType TTL override, in
+// seconds.
+func (c *Config) SetDistUpgradeTTLSeconds(seconds int64) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.DistUpgradeTTLSeconds = seconds
+	return c.save()
+}
+
+// JobTimeout returns the default Timeout, as a time.Duration, for job
+// types other than UpdateSourceJobType and DistUpgradeJobType.
+func (c *Config) JobTimeout() time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s := c.JobTimeoutSeconds
+	if s <= 0 {
+		s = defaultJobTimeoutSeconds
+	}
+	return time.Duration(s) * time.Second
+}
+
+// UpdateSourceTimeout returns the default Timeout for an
+// UpdateSourceJobType job.
+func (c *Config) UpdateSourceTimeout() time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s := c.UpdateSourceTimeoutSeconds
+	if s <= 0 {
+		s = defaultUpdateSourceTimeoutSeconds
+	}
+	return time.Duration(s) * time.Second
+}
+
+// DistUpgradeTimeout returns the default Timeout for a DistUpgradeJobType
+// job.
+func (c *Config) DistUpgradeTimeout() time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s := c.DistUpgradeTimeoutSeconds
+	if s <= 0 {
+		s = defaultDistUpgradeTimeoutSeconds
+	}
+	return time.Duration(s) * time.Second
+}
+
+// SetJobTimeoutSeconds persists the default job timeout, in seconds, used
+// by defaultTimeout for job types other than UpdateSourceJobType and
+// DistUpgradeJobType.
+func (c *Config) SetJobTimeoutSeconds(seconds int64) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.JobTimeoutSeconds = seconds
+	return c.save()
+}
+
+// SetUpdateSourceTimeoutSeconds persists the UpdateSourceJobType timeout
+// override, in seconds.
+func (c *Config) SetUpdateSourceTimeoutSeconds(seconds int64) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.UpdateSourceTimeoutSeconds = seconds
+	return c.save()
+}
+
+// SetDistUpgradeTimeoutSeconds persists the DistUpgradeJobType timeout
+// override, in seconds.
+func (c *Config) SetDistUpgradeTimeoutSeconds(seconds int64) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.DistUpgradeTimeoutSeconds = seconds
+	return c.save()
+}
+
+// LoadConfig reads Config from configPath, returning a usable zero-value
+// Config if it doesn't exist yet.
+func LoadConfig() *Config {
+	c := &Config{LastSchedulerRuns: make(map[string]int64)}
+	data, err := ioutil.ReadFile(configPath)
+	if err == nil {
+		_ = json.Unmarshal(data, c)
+	}
+	if c.LastSchedulerRuns == nil {
+		c.LastSchedulerRuns = make(map[string]int64)
+	}
+	return c
+}
+
+func (c *Config) save() error {
+	data, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(configPath, data, 0644)
+}
+
+// SetAppstoreRegion persists the appstore region used to resolve
+// region-specific package sources.
+func (c *Config) SetAppstoreRegion(region string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.AppstoreRegion = region
+	return c.save()
+}
+
+// SetAutoCheckUpdates toggles whether updateSourceScheduler runs.
+func (c *Config) SetAutoCheckUpdates(enabled bool) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.AutoCheckUpdates = enabled
+	return c.save()
+}
+
+// SetAutoDownloadUpdates toggles whether autoCheckUpdatesScheduler
+// downloads available updates in the background.
+func (c *Config) SetAutoDownloadUpdates(enabled bool) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.AutoDownloadUpdates = enabled
+	return c.save()
+}
+
+// LastSchedulerRun returns when the named scheduler last ran, or nil if it
+// never has.
+func (c *Config) LastSchedulerRun(name string) *time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ts, ok := c.LastSchedulerRuns[name]
+	if !ok {
+		return nil
+	}
+	t := time.Unix(ts, 0)
+	return &t
+}
+
+// SetLastSchedulerRun persists when the named scheduler last ran.
+func (c *Config) SetLastSchedulerRun(name string, t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.LastSchedulerRuns[name] = t.Unix()
+	return c.save()
+}
+
+// SetDownloadSpeedLimit persists bytesPerSec as DownloadQueue's cap.
+func (c *Config) SetDownloadSpeedLimit(bytesPerSec int64) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.DownloadSpeedLimit = bytesPerSec
+	return c.save()
+}
+
+// GetDownloadSpeedLimit returns the configured download speed cap.
+func (c *Config) GetDownloadSpeedLimit() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.DownloadSpeedLimit
+}
+
+// InUnmeteredWindow reports whether t falls within the configured daily
+// unmetered window, during which downloads are never throttled.
+func (c *Config) InUnmeteredWindow(t time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.UnmeteredWindowStart == c.UnmeteredWindowEnd {
+		return false
+	}
+	minute := t.Hour()*60 + t.Minute()
+	if c.UnmeteredWindowStart < c.UnmeteredWindowEnd {
+		return minute >= c.UnmeteredWindowStart && minute < c.UnmeteredWindowEnd
+	}
+	// The window wraps past midnight, e.g. 22:00-06:00.
+	return minute >= c.UnmeteredWindowStart || minute < c.UnmeteredWindowEnd
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"internal/system"
+	"sync/atomic"
+	"time"
+)
+
+// Job represents one asynchronous download or system-changing operation
+// tracked by JobManager.
+type Job struct {
+	Id       string
+	Name     string
+	Type     string
+	Packages []string
+
+	Status     system.Status
+	CreateTime int64
+	FinishTime int64
+
+	Cancelable bool
+	retry      int
+
+	queueName string
+
+	// Dependencies lists the ids of jobs that must reach
+	// system.SucceedStatus before JobQueue.PendingJobs will return this
+	// job, replacing the old two-step job.next chain with a general DAG.
+	Dependencies []string
+
+	// TTLSecondsAfterFinished is how long, after FinishTime, a terminal
+	// job is kept before gcFinishedJobs transitions it to EndStatus.
+	// 0 disables GC for this job.
+	TTLSecondsAfterFinished int64
+
+	// Timeout bounds how long the job may stay in RunningStatus before
+	// timeoutRunningJobs aborts and fails it. 0 disables the timeout.
+	Timeout   time.Duration
+	StartedAt int64
+
+	// Speed is the most recently reported transfer speed, in bytes per
+	// second, used by enforceRateLimit to throttle DownloadQueue.
+	Speed int64
+}
+
+var jobIdSerial int64
+
+func genJobId(jobType string) string {
+	return fmt.Sprintf("%s_%d", jobType, atomic.AddInt64(&jobIdSerial, 1))
+}
+
+// NewJob creates a Job in system.ReadyStatus with a default retry budget.
+func NewJob(name string, packages []string, jobType string, queueName string) *Job {
+	return &Job{
+		Id:         genJobId(jobType),
+		Name:       name,
+		Type:       jobType,
+		Packages:   packages,
+		Status:     system.ReadyStatus,
+		CreateTime: time.Now().Unix(),
+		Cancelable: true,
+		retry:      3,
+		queueName:  queueName,
+	}
+}
+
+// ValidTransitionJobState reports whether a job may move from "from" to
+// "to". EndStatus is terminal and a job can't transition to the status it
+// already has; every other transition is allowed.
+func ValidTransitionJobState(from, to system.Status) bool {
+	return from != to && from != system.EndStatus
+}
+
+// TransitionJobState moves job to status to, recording FinishTime when it
+// lands on a terminal status.
+func TransitionJobState(job *Job, to system.Status) error {
+	if job == nil {
+		return system.NotFoundError
+	}
+	if !ValidTransitionJobState(job.Status, to) {
+		return system.NotSupportError
+	}
+	job.Status = to
+	switch to {
+	case system.SucceedStatus, system.FailedStatus, system.EndStatus:
+		job.FinishTime = time.Now().Unix()
+	}
+	return nil
+}
+
+// DestroyJob releases resources tied to job before it's dropped from its
+// queue. Job holds none today, but JobQueue.Remove calls it unconditionally
+// so callers don't need to know that.
+func DestroyJob(job *Job) {}
+
+// StartSystemJob asks the system backend to start job and, on success,
+// transitions it to RunningStatus.
+func StartSystemJob(sys system.System, job *Job) error {
+	if err := sys.Start(job.Id); err != nil {
+		return err
+	}
+	return TransitionJobState(job, system.RunningStatus)
+}
+
+// _UpdateInfo applies a system.JobProgressInfo to job, returning whether
+// anything changed.
+func (j *Job) _UpdateInfo(info system.JobProgressInfo) bool {
+	changed := false
+	if info.Speed != j.Speed {
+		j.Speed = info.Speed
+		changed = true
+	}
+	if info.Status != j.Status && ValidTransitionJobState(j.Status, info.Status) {
+		if TransitionJobState(j, info.Status) == nil {
+			changed = true
+		}
+	}
+	return changed
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"internal/system"
+	"sort"
+	"time"
+
+	"github.com/boltdb/bolt"
+	log "github.com/cihub/seelog"
+)
+
+const (
+	jobHistoryDBPath = "/var/lib/lastore/job_history.db"
+	jobHistoryBucket = "job_history"
+)
+
+// JobRecord is a point-in-time snapshot of a Job, keyed by (JobID, Version).
+// A new record is appended every time the job transitions through
+// TransitionJobState, so the full lifecycle of a job can be reconstructed
+// even after the daemon restarts.
+type JobRecord struct {
+	JobID      string
+	Version    int
+	Name       string
+	Type       string
+	Packages   []string
+	Status     system.Status
+	CreateTime int64
+	UpdateTime int64
+	FinishTime int64
+	Error      string
+
+	// Dependencies, TTLSecondsAfterFinished, TimeoutSeconds and FinishTime
+	// mirror the matching Job fields, so restoreUnfinishedJobs can rebuild a
+	// job without losing its place in the DAG or its GC/timeout policy.
+	Dependencies            []string
+	TTLSecondsAfterFinished int64
+	TimeoutSeconds          int64
+}
+
+// JobHistoryStore persists JobRecord snapshots so job history survives
+// daemon restarts.
+type JobHistoryStore interface {
+	Append(record JobRecord) error
+	JobHistory(jobId string) ([]JobRecord, error)
+	RecentJobs(limit int) ([]JobRecord, error)
+	Unfinished() ([]JobRecord, error)
+	GC(retention time.Duration) error
+	Close() error
+}
+
+type boltJobHistoryStore struct {
+	db *bolt.DB
+}
+
+// NewJobHistoryStore opens (and creates if necessary) the BoltDB file at path
+// used to back a JobHistoryStore.
+func NewJobHistoryStore(path string) (JobHistoryStore, error) {
+	db, err := bolt.Open(path, 0644, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists([]byte(jobHistoryBucket))
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &boltJobHistoryStore{db: db}, nil
+}
+
+func historyKey(jobId string, version int) []byte {
+	return []byte(fmt.Sprintf("%s/%08d", jobId, version))
+}
+
+func (s *boltJobHistoryStore) Append(record JobRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(jobHistoryBucket))
+		return b.Put(historyKey(record.JobID, record.Version), data)
+	})
+}
+
+func (s *boltJobHistoryStore) JobHistory(jobId string) ([]JobRecord, error) {
+	var records []JobRecord
+	prefix := []byte(jobId + "/")
+	err := s.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket([]byte(jobHistoryBucket)).Cursor()
+		for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+			var r JobRecord
+			if err := json.Unmarshal(v, &r); err != nil {
+				return err
+			}
+			records = append(records, r)
+		}
+		return nil
+	})
+	return records, err
+}
+
+func (s *boltJobHistoryStore) RecentJobs(limit int) ([]JobRecord, error) {
+	var all []JobRecord
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(jobHistoryBucket)).ForEach(func(k, v []byte) error {
+			var r JobRecord
+			if err := json.Unmarshal(v, &r); err != nil {
+				return err
+			}
+			all = append(all, r)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(all, func(i, j int) bool {
+		return all[i].UpdateTime > all[j].UpdateTime
+	})
+	if limit > 0 && len(all) > limit {
+		all = all[:limit]
+	}
+	return all, nil
+}
+
+// neededJobIDs, given the latest known record of every job, returns the ids
+// of jobs whose history must be kept no matter how old it is: nonTerminal
+// holds jobs still Ready/Running/Paused, and neededSucceeded holds every
+// already-Succeeded job one of those still lists in Dependencies
+// (transitively), since dropping a succeeded dependency would leave its
+// dependant's Dependencies entry unresolvable forever. Unfinished() uses
+// this to decide what to hand restoreUnfinishedJobs, and GC uses it to
+// decide what history survives the retention window regardless of age.
+func neededJobIDs(latest map[string]JobRecord) (nonTerminal, neededSucceeded map[string]bool) {
+	nonTerminal = make(map[string]bool)
+	needed := make(map[string]bool)
+	for _, r := range latest {
+		switch r.Status {
+		case system.ReadyStatus, system.RunningStatus, system.PausedStatus:
+			nonTerminal[r.JobID] = true
+			for _, depId := range r.Dependencies {
+				needed[depId] = true
+			}
+		}
+	}
+	for changed := true; changed; {
+		changed = false
+		for depId := range needed {
+			r, ok := latest[depId]
+			if !ok || r.Status != system.SucceedStatus {
+				continue
+			}
+			for _, transitiveId := range r.Dependencies {
+				if !needed[transitiveId] {
+					needed[transitiveId] = true
+					changed = true
+				}
+			}
+		}
+	}
+	neededSucceeded = make(map[string]bool)
+	for depId := range needed {
+		if r, ok := latest[depId]; ok && r.Status == system.SucceedStatus {
+			neededSucceeded[depId] = true
+		}
+	}
+	return nonTerminal, neededSucceeded
+}
+
+// Unfinished returns the latest record of every job whose last known status
+// was not terminal, so the caller can rebuild the in-memory JobList on
+// startup. It also includes any already-Succeeded job that one of those
+// records still lists in Dependencies (transitively), since dropping a
+// succeeded dependency would leave its dependant's Dependencies entry
+// unresolvable forever.
+func (s *boltJobHistoryStore) Unfinished() ([]JobRecord, error) {
+	all, err := s.RecentJobs(0)
+	if err != nil {
+		return nil, err
+	}
+	latest := make(map[string]JobRecord)
+	for _, r := range all {
+		if cur, ok := latest[r.JobID]; !ok || r.Version > cur.Version {
+			latest[r.JobID] = r
+		}
+	}
+
+	nonTerminal, neededSucceeded := neededJobIDs(latest)
+	var unfinished []JobRecord
+	for id := range nonTerminal {
+		unfinished = append(unfinished, latest[id])
+	}
+	for id := range neededSucceeded {
+		unfinished = append(unfinished, latest[id])
+	}
+	return unfinished, nil
+}
+
+// GC removes records whose last update is older than retention, except
+// that it never touches any record belonging to a job neededJobIDs deems
+// still needed: a job that isn't in a terminal status yet (it may simply
+// be idling behind LockQueue or a slow retry loop for longer than
+// retention), or a Succeeded job a not-yet-finished job still depends on.
+// Without this, a restart right after a GC tick would leave
+// restoreUnfinishedJobs nothing to read for that job and silently drop it
+// instead of resuming it, the same class of bug gcFinishedJobs's
+// hasPendingDependants guards against for the in-memory GC.
+func (s *boltJobHistoryStore) GC(retention time.Duration) error {
+	cutoff := time.Now().Add(-retention).Unix()
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(jobHistoryBucket))
+
+		latest := make(map[string]JobRecord)
+		if err := b.ForEach(func(k, v []byte) error {
+			var r JobRecord
+			if err := json.Unmarshal(v, &r); err != nil {
+				return nil
+			}
+			if cur, ok := latest[r.JobID]; !ok || r.Version > cur.Version {
+				latest[r.JobID] = r
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+		nonTerminal, neededSucceeded := neededJobIDs(latest)
+
+		c := b.Cursor()
+		var stale [][]byte
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			var r JobRecord
+			if err := json.Unmarshal(v, &r); err != nil {
+				continue
+			}
+			if nonTerminal[r.JobID] || neededSucceeded[r.JobID] {
+				continue
+			}
+			if r.UpdateTime < cutoff {
+				stale = append(stale, append([]byte{}, k...))
+			}
+		}
+		for _, k := range stale {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *boltJobHistoryStore) Close() error {
+	return s.db.Close()
+}
+
+// gcLoop periodically trims history older than config.JobHistoryRetention()
+// until stop is closed. It re-reads the retention window on every tick
+// rather than freezing it at startup, so SetJobHistoryRetentionDays takes
+// effect on the already-running GC loop.
+func (s *boltJobHistoryStore) gcLoop(config *Config, stop <-chan struct{}) {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := s.GC(config.JobHistoryRetention()); err != nil {
+				log.Warnf("job history GC failed: %v\n", err)
+			}
+		case <-stop:
+			return
+		}
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -32,25 +33,142 @@ type JobManager struct {
 
 	notify  func()
 	changed bool
+
+	history         JobHistoryStore
+	historyVersions map[string]int
+	historyStop     chan struct{}
+
+	// dependants maps a job id to the jobs whose Dependencies list it,
+	// the reverse of Job.Dependencies. It lets a failed or cancelled job
+	// propagate to everything downstream of it in the DAG.
+	//
+	// Like historyVersions, it's a plain map read and written from
+	// addJob/failDependants/hasPendingDependants, which are reachable from
+	// both the locked dispatch() tick and the D-Bus-facing CreateJob/
+	// CleanJob; it's guarded by dispatchLock the same way.
+	dependants map[string][]string
+
+	config *Config
 }
 
-func NewJobManager(api system.System, notifyFn func()) *JobManager {
+// NewJobManager creates a JobManager. config supplies the job history
+// retention window as well as the per-job-type TTL and timeout defaults
+// (see defaultTTL, defaultTimeout).
+func NewJobManager(api system.System, notifyFn func(), config *Config) *JobManager {
 	if api == nil || notifyFn == nil {
 		panic("NewJobManager with api=nil, notifyFn=nil")
 	}
 	m := &JobManager{
-		queues: make(map[string]*JobQueue),
-		notify: notifyFn,
-		system: api,
+		queues:          make(map[string]*JobQueue),
+		notify:          notifyFn,
+		system:          api,
+		historyVersions: make(map[string]int),
+		dependants:      make(map[string][]string),
+		config:          config,
 	}
 	m.createJobList(DownloadQueue, DownloadQueueCap)
 	m.createJobList(SystemChangeQueue, SystemChangeQueueCap)
 	m.createJobList(LockQueue, 1)
 
+	store, err := NewJobHistoryStore(jobHistoryDBPath)
+	if err != nil {
+		log.Warnf("open job history store failed, job history won't be persisted: %v\n", err)
+	} else {
+		m.history = store
+		m.historyStop = make(chan struct{})
+		m.restoreUnfinishedJobs()
+		go store.(*boltJobHistoryStore).gcLoop(config, m.historyStop)
+	}
+
 	api.AttachIndicator(m.handleJobProgressInfo)
 	return m
 }
 
+// recordHistory appends a new version of job to the history store, if one
+// is configured. It is a no-op when persistence failed to open.
+//
+// Callers must hold m.dispatchLock: historyVersions is a plain map and
+// every entry point that can race with the 500ms dispatch tick (MarkStart,
+// PauseJob, CleanJob, CreateJob and handleJobProgressInfo) now takes the
+// lock for its whole call, same as dispatch() itself.
+func (m *JobManager) recordHistory(job *Job, jobErr error) {
+	if m.history == nil || job == nil {
+		return
+	}
+	m.historyVersions[job.Id]++
+	record := JobRecord{
+		JobID:                   job.Id,
+		Version:                 m.historyVersions[job.Id],
+		Name:                    job.Name,
+		Type:                    job.Type,
+		Packages:                job.Packages,
+		Status:                  job.Status,
+		CreateTime:              job.CreateTime,
+		UpdateTime:              time.Now().Unix(),
+		FinishTime:              job.FinishTime,
+		Dependencies:            job.Dependencies,
+		TTLSecondsAfterFinished: job.TTLSecondsAfterFinished,
+		TimeoutSeconds:          int64(job.Timeout.Seconds()),
+	}
+	if jobErr != nil {
+		record.Error = jobErr.Error()
+	}
+	if err := m.history.Append(record); err != nil {
+		log.Warnf("record job history for %q failed: %v\n", job.Id, err)
+	}
+}
+
+// queueNameForJobType maps a JobType to the queue it is dispatched through,
+// mirroring the switch in CreateJob.
+func queueNameForJobType(jobType string) string {
+	switch jobType {
+	case system.DownloadJobType:
+		return DownloadQueue
+	case system.UpdateSourceJobType, system.DistUpgradeJobType:
+		return LockQueue
+	default:
+		return SystemChangeQueue
+	}
+}
+
+// restoreUnfinishedJobs rebuilds the in-memory JobList from history records
+// that were not in a terminal state when the daemon last exited, so paused
+// or pending jobs survive a restart. It also restores any already-Succeeded
+// job that one of those still depends on (JobHistoryStore.Unfinished
+// includes them), since dependenciesSatisfied resolves a dependency via
+// m.find and a restored Install/DistUpgrade would otherwise wait forever on
+// a dependency id that no longer exists anywhere.
+func (m *JobManager) restoreUnfinishedJobs() {
+	records, err := m.history.Unfinished()
+	if err != nil {
+		log.Warnf("load unfinished job history failed: %v\n", err)
+		return
+	}
+	for _, r := range records {
+		job := NewJob(r.Name, r.Packages, r.Type, queueNameForJobType(r.Type))
+		job.Id = r.JobID
+		job.CreateTime = r.CreateTime
+		job.FinishTime = r.FinishTime
+		job.Dependencies = r.Dependencies
+		job.TTLSecondsAfterFinished = r.TTLSecondsAfterFinished
+		job.Timeout = time.Duration(r.TimeoutSeconds) * time.Second
+		switch r.Status {
+		case system.RunningStatus:
+			// The process backing it is gone; restart it from Ready
+			// rather than claiming it's still running.
+			job.Status = system.ReadyStatus
+		default:
+			// Ready, Paused and already-Succeeded dependencies are
+			// preserved as-is.
+			job.Status = r.Status
+		}
+		m.historyVersions[job.Id] = r.Version
+		if err := m.addJob(job); err != nil {
+			log.Warnf("restore job %q failed: %v\n", job.Id, err)
+		}
+	}
+}
+
 func (m *JobManager) List() JobList {
 	var r JobList
 	for _, queue := range m.queues {
@@ -68,22 +186,20 @@ func (m *JobManager) guest(jobType string, packages []string) string {
 		if job.Type == jobType && strings.Join(job.Packages, "") == pList {
 			return job.Id
 		}
-		if job.next == nil {
-			continue
-		}
-		if job.next.Type == jobType && strings.Join(job.next.Packages, "") == pList {
-			// Don't return the job.next.
-			// It's not a workable Job before the Job finished.
-			return job.Id
-		}
 	}
 	return ""
 }
 
 // CreateJob create the job and try starting it
 func (m *JobManager) CreateJob(jobName string, jobType string, packages []string) (*Job, error) {
+	m.dispatchLock.Lock()
+	defer m.dispatchLock.Unlock()
+	return m.createJob(jobName, jobType, packages)
+}
+
+func (m *JobManager) createJob(jobName string, jobType string, packages []string) (*Job, error) {
 	if job := m.find(m.guest(jobType, packages)); job != nil {
-		return job, m.MarkStart(job.Id)
+		return job, m.markStart(job.Id)
 	}
 
 	var job *Job
@@ -91,9 +207,17 @@ func (m *JobManager) CreateJob(jobName string, jobType string, packages []string
 	case system.DownloadJobType:
 		job = NewJob(jobName, packages, system.DownloadJobType, DownloadQueue)
 	case system.InstallJobType:
-		job = NewJob(jobName, packages, system.DownloadJobType, DownloadQueue)
-		job.next = NewJob(jobName, packages, system.InstallJobType, SystemChangeQueue)
-		job.Id = job.next.Id
+		download := NewJob(jobName, packages, system.DownloadJobType, DownloadQueue)
+		download.TTLSecondsAfterFinished = m.defaultTTL(system.DownloadJobType)
+		download.Timeout = m.defaultTimeout(system.DownloadJobType)
+		job = NewJob(jobName, packages, system.InstallJobType, SystemChangeQueue)
+		job.Dependencies = []string{download.Id}
+		if err := m.addJob(download); err != nil {
+			return nil, err
+		}
+		if err := m.markStart(download.Id); err != nil {
+			return nil, err
+		}
 	case system.RemoveJobType:
 		job = NewJob(jobName, packages, system.RemoveJobType, SystemChangeQueue)
 	case system.UpdateSourceJobType:
@@ -105,13 +229,64 @@ func (m *JobManager) CreateJob(jobName string, jobType string, packages []string
 	default:
 		return nil, system.NotSupportError
 	}
+	job.TTLSecondsAfterFinished = m.defaultTTL(jobType)
+	job.Timeout = m.defaultTimeout(jobType)
 	m.addJob(job)
-	return job, m.MarkStart(job.Id)
+	return job, m.markStart(job.Id)
+}
+
+// CreateDistUpgradeTransaction atomically queues one DownloadJobType job per
+// package plus a single DistUpgradeJobType job that depends on all of them,
+// so the whole transaction either completes together or, via DAG failure
+// propagation, fails together. If any package fails to queue (e.g. a manual
+// download of it is already in progress), every job added so far is rolled
+// back rather than left running with no DistUpgrade to claim it.
+func (m *JobManager) CreateDistUpgradeTransaction(jobName string, packages []string) (*Job, error) {
+	m.dispatchLock.Lock()
+	defer m.dispatchLock.Unlock()
+
+	upgrade := NewJob(jobName, packages, system.DistUpgradeJobType, LockQueue)
+	upgrade.TTLSecondsAfterFinished = m.defaultTTL(system.DistUpgradeJobType)
+	upgrade.Timeout = m.defaultTimeout(system.DistUpgradeJobType)
+
+	var added []*Job
+	rollback := func() {
+		for _, j := range added {
+			m.removeJob(j.Id, j.queueName)
+		}
+	}
+
+	for _, p := range packages {
+		download := NewJob(jobName, []string{p}, system.DownloadJobType, DownloadQueue)
+		download.TTLSecondsAfterFinished = m.defaultTTL(system.DownloadJobType)
+		download.Timeout = m.defaultTimeout(system.DownloadJobType)
+		upgrade.Dependencies = append(upgrade.Dependencies, download.Id)
+		if err := m.addJob(download); err != nil {
+			rollback()
+			return nil, err
+		}
+		added = append(added, download)
+		if err := m.markStart(download.Id); err != nil {
+			rollback()
+			return nil, err
+		}
+	}
+	if err := m.addJob(upgrade); err != nil {
+		rollback()
+		return nil, err
+	}
+	return upgrade, m.markStart(upgrade.Id)
 }
 
 // MarkStart transition the Job status to ReadyStatus
 // and move the it to the head of queue.
 func (m *JobManager) MarkStart(jobId string) error {
+	m.dispatchLock.Lock()
+	defer m.dispatchLock.Unlock()
+	return m.markStart(jobId)
+}
+
+func (m *JobManager) markStart(jobId string) error {
 	job := m.find(jobId)
 	if job == nil {
 		return system.NotFoundError
@@ -122,6 +297,7 @@ func (m *JobManager) MarkStart(jobId string) error {
 		if err != nil {
 			return err
 		}
+		m.recordHistory(job, nil)
 	}
 
 	queue, ok := m.queues[job.queueName]
@@ -134,23 +310,70 @@ func (m *JobManager) MarkStart(jobId string) error {
 // CleanJob transition the Job status to EndStatus,
 // so the job will be auto clean in next dispatch run.
 func (m *JobManager) CleanJob(jobId string) error {
+	m.dispatchLock.Lock()
+	defer m.dispatchLock.Unlock()
+	return m.cleanJob(jobId)
+}
+
+func (m *JobManager) cleanJob(jobId string) error {
 	job := m.find(jobId)
 	if job == nil {
 		return system.NotFoundError
 	}
 
 	if job.Status == system.RunningStatus && job.Cancelable {
-		m.PauseJob(jobId)
+		m.pauseJob(jobId)
 	}
 
-	if ValidTransitionJobState(job.Status, system.EndStatus) {
-		job.next = nil
+	err := TransitionJobState(job, system.EndStatus)
+	if err == nil {
+		m.recordHistory(job, nil)
+		m.failDependants(job.Id, fmt.Errorf("upstream job %s was cancelled", job.Id))
+	}
+	return err
+}
+
+// failDependants walks the DAG of jobs depending, transitively, on jobId
+// and transitions each of them to EndStatus, wrapping cause so callers
+// can see which upstream job is responsible instead of a downstream job
+// silently stuck waiting on a dependency that will never succeed.
+//
+// Callers must hold m.dispatchLock, since it reads m.dependants.
+func (m *JobManager) failDependants(jobId string, cause error) {
+	pending := []string{jobId}
+	visited := map[string]bool{jobId: true}
+	for len(pending) > 0 {
+		id := pending[0]
+		pending = pending[1:]
+		for _, depId := range m.dependants[id] {
+			if visited[depId] {
+				continue
+			}
+			visited[depId] = true
+			pending = append(pending, depId)
+
+			dep := m.find(depId)
+			if dep == nil || dep.Status == system.EndStatus {
+				continue
+			}
+			wrapped := fmt.Errorf("dependency %s failed: %v", id, cause)
+			if err := TransitionJobState(dep, system.EndStatus); err == nil {
+				m.recordHistory(dep, wrapped)
+			} else {
+				log.Warnf("propagate failure from %q to dependant %q failed: %v\n", id, depId, err)
+			}
+		}
 	}
-	return TransitionJobState(job, system.EndStatus)
 }
 
 // PauseJob try aborting the job and transition the status to PauseStatus
 func (m *JobManager) PauseJob(jobId string) error {
+	m.dispatchLock.Lock()
+	defer m.dispatchLock.Unlock()
+	return m.pauseJob(jobId)
+}
+
+func (m *JobManager) pauseJob(jobId string) error {
 	job := m.find(jobId)
 	if job == nil {
 		return system.NotFoundError
@@ -165,7 +388,133 @@ func (m *JobManager) PauseJob(jobId string) error {
 		return err
 	}
 
-	return TransitionJobState(job, system.PausedStatus)
+	err = TransitionJobState(job, system.PausedStatus)
+	if err == nil {
+		m.recordHistory(job, nil)
+	}
+	return err
+}
+
+// defaultTTL returns the default TTLSecondsAfterFinished for a job type,
+// overridable via Config: a failed DistUpgrade sticks around for
+// Config.DistUpgradeTTL (a week by default) so the user can inspect it in
+// the UI, everything else uses Config.JobTTL (a minute by default).
+func (m *JobManager) defaultTTL(jobType string) int64 {
+	switch jobType {
+	case system.DistUpgradeJobType:
+		return int64(m.config.DistUpgradeTTL().Seconds())
+	default:
+		return int64(m.config.JobTTL().Seconds())
+	}
+}
+
+// gcFinishedJobs transitions jobs whose Status is terminal (Succeed or
+// Failed) and whose TTLSecondsAfterFinished has elapsed since FinishTime
+// into EndStatus, handing them to the existing EndStatus cleanup pass. This
+// bounds JobList's growth even when a client never calls CleanJob.
+//
+// A succeeded job that some other, not-yet-finished job still depends on is
+// never GC'd regardless of its TTL: dependenciesSatisfied resolves a
+// dependency by looking it up live via m.find, so removing it out from
+// under a pending dependant would wedge that dependant in ReadyStatus
+// forever.
+func (m *JobManager) gcFinishedJobs() {
+	now := time.Now().Unix()
+	for _, queue := range m.queues {
+		for _, job := range queue.Jobs {
+			if job.Status != system.SucceedStatus && job.Status != system.FailedStatus {
+				continue
+			}
+			if job.TTLSecondsAfterFinished <= 0 || job.FinishTime <= 0 {
+				continue
+			}
+			if now-job.FinishTime < job.TTLSecondsAfterFinished {
+				continue
+			}
+			if m.hasPendingDependants(job.Id) {
+				continue
+			}
+			if err := TransitionJobState(job, system.EndStatus); err == nil {
+				m.recordHistory(job, nil)
+			}
+		}
+	}
+}
+
+// hasPendingDependants reports whether any job listing jobId in its
+// Dependencies has not yet reached EndStatus, i.e. still needs to be able
+// to look jobId up via m.find.
+//
+// Callers must hold m.dispatchLock, since it reads m.dependants.
+func (m *JobManager) hasPendingDependants(jobId string) bool {
+	for _, depId := range m.dependants[jobId] {
+		if dep := m.find(depId); dep != nil && dep.Status != system.EndStatus {
+			return true
+		}
+	}
+	return false
+}
+
+// defaultTimeout returns the default Timeout for a job type, overridable
+// via Config; it exists so a hung "apt-get update" inside LockQueue can't
+// leave a downstream DistUpgrade waiting forever.
+func (m *JobManager) defaultTimeout(jobType string) time.Duration {
+	switch jobType {
+	case system.UpdateSourceJobType:
+		return m.config.UpdateSourceTimeout()
+	case system.DistUpgradeJobType:
+		return m.config.DistUpgradeTimeout()
+	default:
+		return m.config.JobTimeout()
+	}
+}
+
+// timeoutRunningJobs aborts and fails any RunningStatus job whose Timeout
+// has elapsed since StartedAt, then propagates the failure to its
+// dependants so they don't wait forever on a dependency that will never
+// finish.
+func (m *JobManager) timeoutRunningJobs() {
+	now := time.Now().Unix()
+	for _, queue := range m.queues {
+		for _, job := range queue.Jobs {
+			if job.Status != system.RunningStatus || job.Timeout <= 0 || job.StartedAt <= 0 {
+				continue
+			}
+			if now-job.StartedAt < int64(job.Timeout.Seconds()) {
+				continue
+			}
+			log.Warnf("job %q timed out after %v, aborting\n", job.Id, job.Timeout)
+			if err := m.system.Abort(job.Id); err != nil {
+				log.Warnf("abort timed-out job %q failed: %v\n", job.Id, err)
+			}
+			if err := TransitionJobState(job, system.FailedStatus); err == nil {
+				m.recordHistory(job, system.TimeoutError)
+				m.failDependants(job.Id, system.TimeoutError)
+			}
+		}
+	}
+}
+
+// dependenciesSatisfied reports whether every job in job.Dependencies has
+// reached system.SucceedStatus, gating PendingJobs the same way job.next
+// used to gate a two-step chain, but for an arbitrary DAG.
+func (m *JobManager) dependenciesSatisfied(job *Job) bool {
+	for _, depId := range job.Dependencies {
+		dep := m.find(depId)
+		if dep == nil || dep.Status != system.SucceedStatus {
+			return false
+		}
+	}
+	return true
+}
+
+// LockQueueBusy reports whether LockQueue currently has a running job, so
+// callers outside JobManager (SchedulerLoop) don't need to reach into
+// m.queues directly and race with dispatch()'s locked mutation of it.
+func (m *JobManager) LockQueueBusy() bool {
+	m.dispatchLock.Lock()
+	defer m.dispatchLock.Unlock()
+	return len(m.queues[LockQueue].RunningJobs()) != 0
 }
 
 func (m *JobManager) find(jobId string) *Job {
@@ -185,6 +534,16 @@ func (m *JobManager) dispatch() {
 	m.dispatchLock.Lock()
 	defer m.dispatchLock.Unlock()
 
+	m.gcFinishedJobs()
+	m.timeoutRunningJobs()
+	// enforceRateLimit is also invoked from handleJobProgressInfo, but that
+	// only fires for currently-running jobs: if the cap ever paused every
+	// running download, no more progress callbacks would arrive and the
+	// queue would stay paused forever. Re-running it on every dispatch
+	// tick guarantees paused downloads are retried even with zero running
+	// jobs to report progress.
+	m.enforceRateLimit(DownloadQueue)
+
 	var pendingDeleteJobs []*Job
 	for _, queue := range m.queues {
 		// 1. Clean Jobs with EndStatus
@@ -192,16 +551,16 @@ func (m *JobManager) dispatch() {
 			switch {
 			case job.Status == system.EndStatus:
 				pendingDeleteJobs = append(pendingDeleteJobs, job)
+			case job.Status == system.FailedStatus && job.retry <= 0:
+				// retries exhausted: the job is stuck failed, so every
+				// dependant downstream of it must be told rather than
+				// wait forever on a dependency that will never succeed.
+				m.failDependants(job.Id, fmt.Errorf("job %s failed", job.Id))
 			}
 		}
 	}
 	for _, job := range pendingDeleteJobs {
 		m.removeJob(job.Id, job.queueName)
-		if job.next != nil {
-			job = job.next
-			m.addJob(job)
-			m.MarkStart(job.Id)
-		}
 	}
 
 	for name, queue := range m.queues {
@@ -211,15 +570,18 @@ func (m *JobManager) dispatch() {
 		}
 
 		// 2. Try starting jobs with ReadyStatus
-		jobs := queue.PendingJobs()
+		jobs := queue.PendingJobs(m.dependenciesSatisfied)
 		for _, job := range jobs {
 			if job.Status == system.FailedStatus {
-				m.MarkStart(job.Id)
+				m.markStart(job.Id)
 				log.Infof("Retry failed Job %v\n", job)
 			}
 			err := StartSystemJob(m.system, job)
 			if err != nil {
 				log.Errorf("StartSystemJob failed %v :%v\n", job, err)
+			} else if job.Status == system.RunningStatus {
+				job.StartedAt = time.Now().Unix()
+				m.recordHistory(job, nil)
 			}
 		}
 	}
@@ -242,6 +604,8 @@ func (m *JobManager) createJobList(name string, cap int) {
 	m.queues[name] = list
 }
 
+// addJob adds j to its queue and records it in m.dependants. Callers must
+// hold m.dispatchLock.
 func (m *JobManager) addJob(j *Job) error {
 	if j == nil {
 		log.Trace("adJob with nil")
@@ -257,23 +621,58 @@ func (m *JobManager) addJob(j *Job) error {
 	if err != nil {
 		return err
 	}
+	for _, depId := range j.Dependencies {
+		m.dependants[depId] = append(m.dependants[depId], j.Id)
+	}
 	m.changed = true
 	return nil
 }
+
+// removeJob removes jobId from its queue and prunes it out of m.dependants
+// so the map doesn't grow without bound over the daemon's lifetime: the
+// key jobId->dependants is dropped since jobId can no longer fail or
+// finish to trigger another failDependants/hasPendingDependants walk, and
+// jobId is pruned from each of its own Dependencies' dependants list since
+// it's no longer a dependant of anything. Callers must hold
+// m.dispatchLock.
 func (m *JobManager) removeJob(jobId string, queueName string) error {
 	queue, ok := m.queues[queueName]
 	if !ok {
 		return system.NotFoundError
 	}
 
+	job := queue.Find(jobId)
 	err := queue.Remove(jobId)
 	if err != nil {
 		return err
 	}
+	delete(m.dependants, jobId)
+	if job != nil {
+		for _, depId := range job.Dependencies {
+			m.pruneDependant(depId, jobId)
+		}
+	}
 	m.changed = true
 	return nil
 }
 
+// pruneDependant removes jobId from depId's dependants list, dropping the
+// entry entirely once it's empty.
+func (m *JobManager) pruneDependant(depId, jobId string) {
+	deps := m.dependants[depId]
+	for i, id := range deps {
+		if id == jobId {
+			deps = append(deps[:i], deps[i+1:]...)
+			break
+		}
+	}
+	if len(deps) == 0 {
+		delete(m.dependants, depId)
+	} else {
+		m.dependants[depId] = deps
+	}
+}
+
 type JobList []*Job
 
 func (l JobList) Len() int {
@@ -293,6 +692,13 @@ type JobQueue struct {
 	Name string
 	Jobs JobList
 	Cap  int
+
+	// BytesPerSecond caps the aggregate speed of this queue's running
+	// jobs; 0 means unlimited. Only DownloadQueue uses it today. It's
+	// written from downloadSpeedLimitLoop and read from both the dispatch
+	// loop and the indicator callback goroutine, so access always goes
+	// through sync/atomic rather than a plain load/store.
+	BytesPerSecond int64
 }
 
 func NewJobQueue(name string, cap int) *JobQueue {
@@ -302,21 +708,25 @@ func NewJobQueue(name string, cap int) *JobQueue {
 	}
 }
 
-// PendingJob get the workable ready Jobs and recoverable failed Jobs
-func (l *JobQueue) PendingJobs() JobList {
+// PendingJob get the workable ready Jobs and recoverable failed Jobs.
+// satisfied reports whether a job's Dependencies have all succeeded; a job
+// whose dependencies aren't satisfied yet is left out until they are.
+func (l *JobQueue) PendingJobs(satisfied func(job *Job) bool) JobList {
 	var numRunning int
 	var readyJobs []*Job
 	for _, job := range l.Jobs {
 		switch job.Status {
 		case system.FailedStatus:
-			if job.retry > 0 {
+			if job.retry > 0 && satisfied(job) {
 				job.retry--
 				readyJobs = append(readyJobs, job)
 			}
 		case system.RunningStatus:
 			numRunning = numRunning + 1
 		case system.ReadyStatus:
-			readyJobs = append(readyJobs, job)
+			if satisfied(job) {
+				readyJobs = append(readyJobs, job)
+			}
 		}
 	}
 	space := l.Cap - numRunning
@@ -404,7 +814,16 @@ func (l *JobQueue) Find(id string) *Job {
 	return nil
 }
 
+// handleJobProgressInfo is the system.System backend's indicator callback,
+// invoked on its own goroutine. It takes m.dispatchLock for its whole body
+// because enforceRateLimit below can pause/resume other jobs in the same
+// queue (pauseJob/markStart change job statuses and markStart's Raise
+// reorders queue.Jobs), and that must not interleave with dispatch()'s own locked walk of the
+// same slice.
 func (m *JobManager) handleJobProgressInfo(info system.JobProgressInfo) {
+	m.dispatchLock.Lock()
+	defer m.dispatchLock.Unlock()
+
 	j := m.find(info.JobId)
 	if j == nil {
 		log.Warnf("Can't find Job %q when update info %v\n", info.JobId, info)
@@ -413,5 +832,66 @@ func (m *JobManager) handleJobProgressInfo(info system.JobProgressInfo) {
 
 	if j._UpdateInfo(info) {
 		m.changed = true
+		m.recordHistory(j, nil)
+	}
+	m.enforceRateLimit(j.queueName)
+}
+
+// enforceRateLimit keeps the aggregate speed of a queue's running jobs
+// within its BytesPerSecond cap by pausing the most recently created
+// downloads first, and resumes paused ones once there's headroom again.
+// Pausing goes through pauseJob, which aborts the job in the system
+// backend; resuming re-queues it via markStart.
+//
+// Callers must hold m.dispatchLock: it's invoked both from dispatch() and
+// from handleJobProgressInfo, which runs on the system backend's indicator
+// callback goroutine, and it mutates queue.Jobs via the pauseJob/markStart
+// that PendingJobs/dispatch also walk.
+func (m *JobManager) enforceRateLimit(queueName string) {
+	queue, ok := m.queues[queueName]
+	if !ok {
+		return
+	}
+	limit := atomic.LoadInt64(&queue.BytesPerSecond)
+	if limit <= 0 {
+		return
+	}
+
+	var running JobList
+	var total int64
+	for _, job := range queue.Jobs {
+		if job.Status == system.RunningStatus {
+			running = append(running, job)
+			total += job.Speed
+		}
+	}
+
+	if total > limit {
+		sort.Sort(sort.Reverse(running))
+		for _, job := range running {
+			if total <= limit {
+				break
+			}
+			if err := m.pauseJob(job.Id); err != nil {
+				log.Warnf("throttle: pause job %q failed: %v\n", job.Id, err)
+				continue
+			}
+			total -= job.Speed
+		}
+		return
+	}
+
+	for _, job := range queue.Jobs {
+		if job.Status != system.PausedStatus {
+			continue
+		}
+		if total+job.Speed > limit {
+			continue
+		}
+		if err := m.markStart(job.Id); err != nil {
+			log.Warnf("throttle: resume job %q failed: %v\n", job.Id, err)
+			continue
+		}
+		total += job.Speed
 	}
 }
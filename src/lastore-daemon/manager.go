@@ -2,6 +2,8 @@ package main
 
 import (
 	"internal/system"
+	"sync/atomic"
+	"time"
 )
 
 type Manager struct {
@@ -16,6 +18,9 @@ type Manager struct {
 	UpgradableApps []string
 
 	SystemOnChanging bool
+
+	AutoCheckUpdates    bool
+	AutoDownloadUpdates bool
 }
 
 func NewManager(b system.System, c *Config) *Manager {
@@ -23,12 +28,16 @@ func NewManager(b system.System, c *Config) *Manager {
 		config:              c,
 		b:                   b,
 		SystemArchitectures: b.SystemArchitectures(),
+		AutoCheckUpdates:    c.AutoCheckUpdates,
+		AutoDownloadUpdates: c.AutoDownloadUpdates,
 	}
-	m.jobManager = NewJobManager(b, m.updateJobList)
+	m.jobManager = NewJobManager(b, m.updateJobList, c)
 
 	b.AttachIndicator(m.jobManager.handleJobProgressInfo)
 
 	go m.jobManager.Dispatch()
+	go m.SchedulerLoop([]Scheduler{updateSourceScheduler{}, autoCheckUpdatesScheduler{}})
+	go m.downloadSpeedLimitLoop()
 
 	m.updatableApps()
 	m.updateJobList()
@@ -79,7 +88,10 @@ func (m *Manager) DistUpgrade() (*Job, error) {
 		m.CleanJob(jobId)
 	}
 
-	return m.jobManager.CreateJob(system.DistUpgradeJobType, "")
+	// Queue one download per upgradable package feeding a single
+	// DistUpgradeJobType job, so the whole transaction fails together via
+	// DAG cancellation if any download fails.
+	return m.jobManager.CreateDistUpgradeTransaction("", m.UpgradableApps)
 }
 
 func (m *Manager) StartJob(jobId string) error {
@@ -114,3 +126,107 @@ func (m *Manager) PackageDesktopPath(packageId string) string {
 func (m *Manager) SetRegion(region string) error {
 	return m.config.SetAppstoreRegion(region)
 }
+
+// SetAutoCheckUpdates toggles the scheduler that periodically refreshes
+// the package source.
+func (m *Manager) SetAutoCheckUpdates(enabled bool) error {
+	err := m.config.SetAutoCheckUpdates(enabled)
+	if err != nil {
+		return err
+	}
+	m.AutoCheckUpdates = enabled
+	return nil
+}
+
+// SetAutoDownloadUpdates toggles the scheduler that automatically
+// downloads available updates in the background.
+func (m *Manager) SetAutoDownloadUpdates(enabled bool) error {
+	err := m.config.SetAutoDownloadUpdates(enabled)
+	if err != nil {
+		return err
+	}
+	m.AutoDownloadUpdates = enabled
+	return nil
+}
+
+// SetJobHistoryRetentionDays persists how many days of finished job
+// history the history store's GC keeps before trimming it.
+func (m *Manager) SetJobHistoryRetentionDays(days int) error {
+	return m.config.SetJobHistoryRetentionDays(days)
+}
+
+// SetJobTTLSeconds persists the default TTLSecondsAfterFinished, in
+// seconds, that gcFinishedJobs applies to job types other than
+// DistUpgradeJobType.
+func (m *Manager) SetJobTTLSeconds(seconds int64) error {
+	return m.config.SetJobTTLSeconds(seconds)
+}
+
+// SetDistUpgradeTTLSeconds persists the DistUpgradeJobType TTL override, in
+// seconds, so a failed upgrade can be kept visible in the UI longer than
+// other job types.
+func (m *Manager) SetDistUpgradeTTLSeconds(seconds int64) error {
+	return m.config.SetDistUpgradeTTLSeconds(seconds)
+}
+
+// SetJobTimeoutSeconds persists the default Timeout, in seconds, that
+// timeoutRunningJobs applies to job types other than UpdateSourceJobType
+// and DistUpgradeJobType.
+func (m *Manager) SetJobTimeoutSeconds(seconds int64) error {
+	return m.config.SetJobTimeoutSeconds(seconds)
+}
+
+// SetUpdateSourceTimeoutSeconds persists the UpdateSourceJobType timeout
+// override, in seconds.
+func (m *Manager) SetUpdateSourceTimeoutSeconds(seconds int64) error {
+	return m.config.SetUpdateSourceTimeoutSeconds(seconds)
+}
+
+// SetDistUpgradeTimeoutSeconds persists the DistUpgradeJobType timeout
+// override, in seconds.
+func (m *Manager) SetDistUpgradeTimeoutSeconds(seconds int64) error {
+	return m.config.SetDistUpgradeTimeoutSeconds(seconds)
+}
+
+// JobHistory returns every persisted version of the job identified by
+// jobId, oldest first.
+func (m *Manager) JobHistory(jobId string) ([]JobRecord, error) {
+	if m.jobManager.history == nil {
+		return nil, system.NotFoundError
+	}
+	return m.jobManager.history.JobHistory(jobId)
+}
+
+// RecentJobs returns, at most, the limit most recently updated job records
+// across all job types, newest first. A limit of 0 or less returns every
+// record.
+func (m *Manager) RecentJobs(limit int) ([]JobRecord, error) {
+	if m.jobManager.history == nil {
+		return nil, system.NotFoundError
+	}
+	return m.jobManager.history.RecentJobs(limit)
+}
+
+// SetDownloadSpeedLimit caps the aggregate speed of running downloads to
+// bytesPerSec, 0 meaning unlimited. It persists the limit so it survives a
+// restart; downloadSpeedLimitLoop re-applies it to the queue, honoring
+// Config's unmetered schedule window, and enforceRateLimit throttles
+// individual jobs to stay under it.
+func (m *Manager) SetDownloadSpeedLimit(bytesPerSec int64) error {
+	return m.config.SetDownloadSpeedLimit(bytesPerSec)
+}
+
+// downloadSpeedLimitLoop re-applies the configured download speed cap to
+// DownloadQueue once a minute, honoring Config's unmetered schedule window
+// (e.g. unmetered 02:00-06:00, capped otherwise), so background
+// auto-download from the scheduler stays safe on metered connections.
+func (m *Manager) downloadSpeedLimitLoop() {
+	for {
+		limit := m.config.GetDownloadSpeedLimit()
+		if m.config.InUnmeteredWindow(time.Now()) {
+			limit = 0
+		}
+		atomic.StoreInt64(&m.jobManager.queues[DownloadQueue].BytesPerSecond, limit)
+		time.Sleep(time.Minute)
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"internal/system"
+	"math/rand"
+	"time"
+
+	log "github.com/cihub/seelog"
+)
+
+const (
+	updateSourceInterval = 24 * time.Hour
+	updateSourceJitter   = 30 * time.Minute
+
+	updateSourceSchedulerName = "update-source"
+	autoCheckUpdatesName      = "auto-check-updates"
+)
+
+// Scheduler describes a recurring background task driven by SchedulerLoop,
+// such as periodically refreshing the package source or checking for
+// updates. Implementations must be stateless; SchedulerLoop is the only
+// thing that tracks when a Scheduler last ran.
+type Scheduler interface {
+	Name() string
+	Enabled(cfg *Config) bool
+	NextScheduledTime(now time.Time, last *time.Time) time.Time
+	ScheduleJob(m *Manager) (*Job, error)
+}
+
+// jitter returns a random duration in [0, max), so many machines polling on
+// the same nominal interval don't all wake up at once.
+func jitter(max time.Duration) time.Duration {
+	if max <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(max)))
+}
+
+// updateSourceScheduler triggers an UpdateSource job roughly once a day.
+type updateSourceScheduler struct{}
+
+func (updateSourceScheduler) Name() string { return updateSourceSchedulerName }
+
+func (updateSourceScheduler) Enabled(cfg *Config) bool {
+	return cfg.AutoCheckUpdates
+}
+
+func (updateSourceScheduler) NextScheduledTime(now time.Time, last *time.Time) time.Time {
+	if last == nil {
+		return now
+	}
+	return last.Add(updateSourceInterval + jitter(updateSourceJitter))
+}
+
+func (updateSourceScheduler) ScheduleJob(m *Manager) (*Job, error) {
+	return m.UpdateSource()
+}
+
+// autoCheckUpdatesScheduler pre-fetches every app that UpgradableApps
+// reports, so an update is ready to install as soon as the user opens the
+// store, without installing anything on its own. It shares
+// updateSourceScheduler's cadence since it only makes sense once the
+// source has been refreshed.
+type autoCheckUpdatesScheduler struct{}
+
+func (autoCheckUpdatesScheduler) Name() string { return autoCheckUpdatesName }
+
+func (autoCheckUpdatesScheduler) Enabled(cfg *Config) bool {
+	return cfg.AutoCheckUpdates && cfg.AutoDownloadUpdates
+}
+
+func (autoCheckUpdatesScheduler) NextScheduledTime(now time.Time, last *time.Time) time.Time {
+	if last == nil {
+		return now
+	}
+	return last.Add(updateSourceInterval + jitter(updateSourceJitter))
+}
+
+func (autoCheckUpdatesScheduler) ScheduleJob(m *Manager) (*Job, error) {
+	m.updatableApps()
+	var firstErr error
+	for _, id := range m.UpgradableApps {
+		if _, err := m.jobManager.CreateJob(id, system.DownloadJobType, []string{id}); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return nil, firstErr
+}
+
+// minSchedulerPoll bounds how often SchedulerLoop re-checks, so a scheduler
+// that has never run successfully (whose NextScheduledTime(now, nil) is
+// always "now") or a due
+// scheduler repeatedly skipped because LockQueue is busy can't spin the
+// loop at 0% sleep.
+const minSchedulerPoll = time.Minute
+
+// SchedulerLoop wakes on the earliest NextScheduledTime among enabled
+// schedulers, runs whichever ones are due and records their last-run time,
+// then sleeps until the next one is due. A due scheduler is skipped for
+// this tick (and retried on the next wakeup) while LockQueue is busy, so a
+// slow "apt-get update" can't cause source updates to pile up.
+func (m *Manager) SchedulerLoop(schedulers []Scheduler) {
+	for {
+		now := time.Now()
+		next := now.Add(updateSourceInterval)
+		for _, s := range schedulers {
+			if !s.Enabled(m.config) {
+				continue
+			}
+			t := s.NextScheduledTime(now, m.config.LastSchedulerRun(s.Name()))
+			if t.Before(next) {
+				next = t
+			}
+		}
+		sleep := next.Sub(now)
+		if sleep < minSchedulerPoll {
+			sleep = minSchedulerPoll
+		}
+		time.Sleep(sleep)
+
+		now = time.Now()
+		for _, s := range schedulers {
+			if !s.Enabled(m.config) {
+				continue
+			}
+			last := m.config.LastSchedulerRun(s.Name())
+			if now.Before(s.NextScheduledTime(now, last)) {
+				continue
+			}
+			if m.jobManager.LockQueueBusy() {
+				continue
+			}
+			if _, err := s.ScheduleJob(m); err != nil {
+				log.Warnf("scheduler %q failed: %v\n", s.Name(), err)
+				continue
+			}
+			if err := m.config.SetLastSchedulerRun(s.Name(), now); err != nil {
+				log.Warnf("persist last run of scheduler %q failed: %v\n", s.Name(), err)
+			}
+		}
+	}
+}